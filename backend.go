@@ -0,0 +1,44 @@
+package zdfs
+
+import (
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/snapshots"
+)
+
+const (
+	// backendLabel selects which LayerBackend materializes a snapshot,
+	// overriding the package-level blockEngine default.
+	backendLabel = "containerd.io/snapshot/zdfs.backend"
+
+	backendNameOverlaybd = "overlaybd"
+	backendNameComposefs = "composefs"
+)
+
+// LayerBackend materializes a prepared zdfs layer on disk and turns it into
+// the mounts containerd hands to the container runtime. overlaybdLayerBackend
+// is the original implementation, backed by the overlaybd TCMU device;
+// composefsLayerBackend is a kernel-native, rootless-friendly alternative
+// that needs no TCMU device.
+type LayerBackend interface {
+	// Prepare materializes dir (whose parent, if any, is parent) so that
+	// Mount can later assemble it into a mount for containerd. info is the
+	// zero value when dir belongs to an already-prepared parent snapshot.
+	Prepare(dir, parent string, info snapshots.Info) error
+	// Mount returns the mounts needed to expose dir's merged view to a
+	// container.
+	Mount(dir string, info snapshots.Info) ([]mount.Mount, error)
+}
+
+// selectLayerBackend picks the LayerBackend for a snapshot, driven by the
+// zdfs.backend label and falling back to the package-level blockEngine
+// default (itself empty unless set by the snapshotter at startup).
+func selectLayerBackend(info snapshots.Info) LayerBackend {
+	name := info.Labels[backendLabel]
+	if name == "" {
+		name = blockEngine
+	}
+	if name == backendNameComposefs {
+		return composefsLayerBackend{}
+	}
+	return overlaybdLayerBackend{}
+}
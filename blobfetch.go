@@ -0,0 +1,49 @@
+package zdfs
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+
+	"github.com/pkg/errors"
+)
+
+// readImageRef returns the image reference a snapshot was pulled from, as
+// recorded by the differ in the image_ref sidecar file, so TOC-driven
+// layer formats can build a blob URL for range requests the same way
+// PrepareOverlayBDSpec's makeConfig does for the registry repo URL.
+func readImageRef(dir string) (string, bool) {
+	refPath := path.Join(dir, "image_ref")
+	if b, _ := pathExists(refPath); !b {
+		return "", false
+	}
+	data, err := os.ReadFile(refPath)
+	if err != nil {
+		return "", false
+	}
+	return string(data), true
+}
+
+// fetchBlobRange issues an HTTP Range request for [start, end] (inclusive)
+// against url and returns the body. It is used to pull just the TOC out of
+// a remote layer blob instead of downloading the whole thing.
+func fetchBlobRange(url string, start, end int64) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to range-fetch %s", url)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent && resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s range-fetching %s", resp.Status, url)
+	}
+	return io.ReadAll(resp.Body)
+}
@@ -0,0 +1,215 @@
+package zdfs
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"os"
+	"path"
+
+	"github.com/containerd/continuity"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// blobStoreRoot is the shared, content-addressed store that every
+	// snapshot's meta files are deduplicated into.
+	blobStoreRoot           = "/var/lib/zdfs/blobs"
+	blobStoreRefcountDB     = "refcounts.db"
+	blobStoreRefcountBucket = "refcounts"
+)
+
+func blobStoreObjectPath(sum string) string {
+	return path.Join(blobStoreRoot, "sha256", sum)
+}
+
+func blobStoreDB() (*bolt.DB, error) {
+	if err := os.MkdirAll(path.Join(blobStoreRoot, "sha256"), 0755); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path.Join(blobStoreRoot, blobStoreRefcountDB), 0600, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open zdfs blob store refcount db")
+	}
+	return db, nil
+}
+
+func sha256File(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// linkIntoBlobStore ensures srcPath's content is present in the shared
+// object store under its sha256 digest -- committing it the first time that
+// digest is seen -- and hardlinks dstPath to the canonical copy, bumping its
+// refcount. Snapshots that happen to carry byte-identical meta files, the
+// common case for a base layer shared across many images, end up linked to
+// the same object instead of each storing their own copy.
+func linkIntoBlobStore(srcPath, dstPath string) error {
+	sum, err := sha256File(srcPath)
+	if err != nil {
+		return err
+	}
+	objPath := blobStoreObjectPath(sum)
+
+	db, err := blobStoreDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	replacingDst := false
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(blobStoreRefcountBucket))
+		if err != nil {
+			return err
+		}
+		if _, statErr := os.Stat(objPath); os.IsNotExist(statErr) {
+			data, err := os.ReadFile(srcPath)
+			if err != nil {
+				return err
+			}
+			if err := continuity.AtomicWriteFile(objPath, data, 0444); err != nil {
+				return errors.Wrapf(err, "failed to commit %s into zdfs blob store", objPath)
+			}
+		}
+		if err := bumpRefcount(bucket, sum, 1); err != nil {
+			return err
+		}
+
+		// dstPath may already be hardlinked to a different (or the same)
+		// blob store object from an earlier call -- e.g. a retried Prepare
+		// after a crash. Release that object's refcount here, in the same
+		// transaction as the new one's bump, so a replaced dstPath never
+		// leaves an object permanently over-counted and unreclaimable by
+		// ReleaseZdfsBlobs.
+		oldSum, statErr := sha256File(dstPath)
+		if statErr != nil {
+			if !os.IsNotExist(statErr) {
+				return statErr
+			}
+			return nil
+		}
+		replacingDst = true
+		if oldSum == sum {
+			return bumpRefcount(bucket, sum, -1)
+		}
+		if err := bumpRefcount(bucket, oldSum, -1); err != nil {
+			return err
+		}
+		if bucket.Get([]byte(oldSum)) == nil {
+			oldObjPath := blobStoreObjectPath(oldSum)
+			if err := os.Remove(oldObjPath); err != nil && !os.IsNotExist(err) {
+				logrus.Errorf("LSMD ERROR failed to remove zdfs blob store object %s, err:%s", oldObjPath, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if replacingDst {
+		if err := os.Remove(dstPath); err != nil {
+			return err
+		}
+	}
+	if err := os.Link(objPath, dstPath); err != nil {
+		return errors.Wrapf(err, "failed to hardlink %s from zdfs blob store object %s", dstPath, objPath)
+	}
+	return nil
+}
+
+// writeIntoBlobStore writes data to dstPath by way of the shared blob
+// store, the same as copyZdfsFiles does for sidecars that already exist on
+// disk -- so callers that synthesize a sidecar's content in memory (rather
+// than copying it from an existing file) still get deduplication and
+// accurate refcounts.
+func writeIntoBlobStore(dstPath string, data []byte) error {
+	tmp, err := os.CreateTemp(path.Dir(dstPath), ".zdfs-blobstore-tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return linkIntoBlobStore(tmpPath, dstPath)
+}
+
+func bumpRefcount(bucket *bolt.Bucket, sum string, delta int64) error {
+	key := []byte(sum)
+	var count int64
+	if v := bucket.Get(key); v != nil {
+		count = int64(binary.BigEndian.Uint64(v))
+	}
+	count += delta
+	if count <= 0 {
+		return bucket.Delete(key)
+	}
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(count))
+	return bucket.Put(key, buf)
+}
+
+// ReleaseZdfsBlobs decrements the shared-object refcount for every meta file
+// the snapshot at dir hardlinked out of the blob store during Prepare, and
+// unlinks any object whose refcount drops to zero. The snapshotter should
+// call this from its Remove, before deleting dir, to reclaim objects that no
+// other snapshot references any more.
+func ReleaseZdfsBlobs(dir string) error {
+	db, err := blobStoreDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(blobStoreRefcountBucket))
+		if err != nil {
+			return err
+		}
+		for _, sub := range []string{zdfsMetaDir, "block"} {
+			subDir := path.Join(dir, sub)
+			for _, name := range append([]string{iNewFormat}, zdfsSidecarFileNames...) {
+				p := path.Join(subDir, name)
+				sum, err := sha256File(p)
+				if err != nil {
+					if os.IsNotExist(err) {
+						continue
+					}
+					return err
+				}
+				if err := bumpRefcount(bucket, sum, -1); err != nil {
+					return err
+				}
+				if bucket.Get([]byte(sum)) == nil {
+					objPath := blobStoreObjectPath(sum)
+					if err := os.Remove(objPath); err != nil && !os.IsNotExist(err) {
+						logrus.Errorf("LSMD ERROR failed to remove zdfs blob store object %s, err:%s", objPath, err)
+					}
+				}
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,72 @@
+package zdfs
+
+import (
+	"encoding/binary"
+	"path"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func withRefcountBucket(t *testing.T, fn func(bucket *bolt.Bucket)) {
+	t.Helper()
+	dbPath := path.Join(t.TempDir(), "refcounts.db")
+	db, err := bolt.Open(dbPath, 0600, nil)
+	if err != nil {
+		t.Fatalf("bolt.Open() error: %s", err)
+	}
+	defer db.Close()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(blobStoreRefcountBucket))
+		if err != nil {
+			return err
+		}
+		fn(bucket)
+		return nil
+	}); err != nil {
+		t.Fatalf("db.Update() error: %s", err)
+	}
+}
+
+func getRefcount(bucket *bolt.Bucket, sum string) int64 {
+	v := bucket.Get([]byte(sum))
+	if v == nil {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(v))
+}
+
+func TestBumpRefcount(t *testing.T) {
+	withRefcountBucket(t, func(bucket *bolt.Bucket) {
+		const sum = "deadbeef"
+
+		if err := bumpRefcount(bucket, sum, 1); err != nil {
+			t.Fatalf("bumpRefcount(+1) error: %s", err)
+		}
+		if got := getRefcount(bucket, sum); got != 1 {
+			t.Fatalf("refcount after +1 = %d, want 1", got)
+		}
+
+		if err := bumpRefcount(bucket, sum, 1); err != nil {
+			t.Fatalf("bumpRefcount(+1) error: %s", err)
+		}
+		if got := getRefcount(bucket, sum); got != 2 {
+			t.Fatalf("refcount after +1+1 = %d, want 2", got)
+		}
+
+		if err := bumpRefcount(bucket, sum, -1); err != nil {
+			t.Fatalf("bumpRefcount(-1) error: %s", err)
+		}
+		if got := getRefcount(bucket, sum); got != 1 {
+			t.Fatalf("refcount after +1+1-1 = %d, want 1", got)
+		}
+
+		if err := bumpRefcount(bucket, sum, -1); err != nil {
+			t.Fatalf("bumpRefcount(-1) error: %s", err)
+		}
+		if v := bucket.Get([]byte(sum)); v != nil {
+			t.Fatalf("refcount key %q still present after dropping to zero", sum)
+		}
+	})
+}
@@ -0,0 +1,177 @@
+package zdfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/continuity"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// composefsObjectsRoot is the shared, content-addressed store that
+	// every composefs-backed snapshot's file content is deduplicated into.
+	composefsObjectsRoot = "/var/lib/zdfs/objects"
+
+	composefsDir           = "composefs"
+	composefsImageFile     = "fs.erofs"
+	composefsMergedDir     = "merged"
+	composefsAncestorsFile = "ancestors.json" // this layer's own dir plus every ancestor's, top-first
+)
+
+// composefsLayerBackend is the rootless-friendly, kernel-native
+// alternative to overlaybdLayerBackend: it converts a layer's unpacked
+// tree into an EROFS image with composefs verity digests over a shared
+// object store, and mounts it as a lower under overlayfs instead of
+// talking to the overlaybd TCMU device.
+type composefsLayerBackend struct{}
+
+func (composefsLayerBackend) Prepare(dir, parent string, info snapshots.Info) error {
+	if err := os.MkdirAll(path.Join(dir, composefsDir), 0755); err != nil {
+		return err
+	}
+
+	imagePath := composefsImagePath(dir)
+	if exists, err := pathExists(imagePath); err != nil {
+		return err
+	} else if !exists {
+		if err := os.MkdirAll(composefsObjectsRoot, 0755); err != nil {
+			return err
+		}
+
+		srcDir := path.Join(dir, "fs")
+		// mkcomposefs (from the composefs project) walks srcDir, hardlinks
+		// each regular file's content into --digest-store by its
+		// fs-verity digest, and emits an EROFS image at imagePath that
+		// references those objects instead of embedding file data.
+		cmd := exec.Command("mkcomposefs", "--digest-store="+composefsObjectsRoot, srcDir, imagePath)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			logrus.Errorf("LSMD ERROR mkcomposefs(%s, %s) failed: %s, err:%s", srcDir, imagePath, out, err)
+			return errors.Wrapf(err, "failed to build composefs image for %s", dir)
+		}
+
+		logrus.Infof("built composefs image %s for %s against shared object store %s", imagePath, dir, composefsObjectsRoot)
+	}
+
+	// Record the full ancestor chain, top (this layer) first, so Mount can
+	// later join every ancestor's own merged dir into one overlayfs
+	// lowerdir= -- the composefs counterpart of how constructSpec chains
+	// parentConfJSON.Lowers for the overlaybd backend.
+	ancestors := []string{dir}
+	if parent != "" {
+		parentAncestors, err := loadComposefsAncestors(parent)
+		if err != nil {
+			return errors.Wrapf(err, "failed to load composefs ancestors of parent %s", parent)
+		}
+		ancestors = append(ancestors, parentAncestors...)
+	}
+	return writeComposefsAncestors(dir, ancestors)
+}
+
+func (composefsLayerBackend) Mount(dir string, info snapshots.Info) ([]mount.Mount, error) {
+	imagePath := composefsImagePath(dir)
+	if exists, err := pathExists(imagePath); err != nil {
+		return nil, err
+	} else if !exists {
+		return nil, fmt.Errorf("LSMD ERROR composefs image does not exist for %s", dir)
+	}
+
+	ancestors, err := loadComposefsAncestors(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to load composefs ancestors of %s", dir)
+	}
+
+	// Every ancestor's own EROFS image is just an unpacked layer, not
+	// itself a union, so each one needs mounting at its own merged dir
+	// before overlayfs can stack them into one lowerdir= chain. Do that
+	// ourselves here rather than handing back erofs mount.Mount values
+	// for the caller to mount later: Mount.Target is resolved by
+	// fs.RootPath as relative to the *container rootfs* the caller is
+	// assembling, not as the absolute host path mergedDir -- the same
+	// reason overlaybdLayerBackend.Mount mounts its device itself instead
+	// of returning it. erofs images are regular files, not block
+	// devices, so mount(2) needs the "loop" option to set one up.
+	lowerDirs := make([]string, 0, len(ancestors))
+	for _, ancestorDir := range ancestors {
+		mergedDir := path.Join(ancestorDir, composefsDir, composefsMergedDir)
+		if err := os.MkdirAll(mergedDir, 0755); err != nil {
+			return nil, err
+		}
+		erofs := mount.Mount{
+			// data served from composefsObjectsRoot via the digests
+			// embedded in the image.
+			Type:    "erofs",
+			Source:  composefsImagePath(ancestorDir),
+			Options: []string{"ro", "loop"},
+		}
+		if err := erofs.Mount(mergedDir); err != nil {
+			return nil, errors.Wrapf(err, "failed to mount composefs image %s at %s", erofs.Source, mergedDir)
+		}
+		lowerDirs = append(lowerDirs, mergedDir)
+	}
+
+	// Every ancestor's merged dir is its own independent mount, not
+	// sub-paths of one combined tree the way overlaybdLayerBackend's
+	// single merged block device is, so each one needs its own idmapped
+	// mount: idmapped mounts exist precisely so a shared, unmodified
+	// source can be presented with different per-consumer ownership
+	// without copying data, which is an argument for remapping every
+	// ancestor, not just the top one -- otherwise files inherited from
+	// lower layers keep showing their original host UIDs. Each gets its
+	// own scratch subdir under dir so the per-ancestor applyIDMap calls
+	// don't collide on the same idmap-src/idmapped paths.
+	for i, lowerDir := range lowerDirs {
+		bind := mount.Mount{Type: "bind", Source: lowerDir, Options: []string{"ro", "rbind"}}
+		idmapDir := path.Join(dir, "idmap", strconv.Itoa(i))
+		if idm, ok, err := applyIDMap(idmapDir, &bind, info); err != nil {
+			return nil, err
+		} else if ok {
+			lowerDirs[i] = idm.Source
+		}
+	}
+
+	return []mount.Mount{{
+		Type:   "overlay",
+		Source: "overlay",
+		Options: []string{
+			"lowerdir=" + strings.Join(lowerDirs, ":"),
+		},
+	}}, nil
+}
+
+func composefsImagePath(dir string) string {
+	return path.Join(dir, composefsDir, composefsImageFile)
+}
+
+func composefsAncestorsPath(dir string) string {
+	return path.Join(dir, composefsDir, composefsAncestorsFile)
+}
+
+func loadComposefsAncestors(dir string) ([]string, error) {
+	data, err := os.ReadFile(composefsAncestorsPath(dir))
+	if err != nil {
+		return nil, err
+	}
+	var ancestors []string
+	if err := json.Unmarshal(data, &ancestors); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal composefs ancestors")
+	}
+	return ancestors, nil
+}
+
+func writeComposefsAncestors(dir string, ancestors []string) error {
+	data, err := json.Marshal(ancestors)
+	if err != nil {
+		return err
+	}
+	return continuity.AtomicWriteFile(composefsAncestorsPath(dir), data, 0644)
+}
@@ -0,0 +1,34 @@
+package zdfs
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestComposefsAncestorsRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(path.Join(dir, composefsDir), 0755); err != nil {
+		t.Fatalf("os.MkdirAll() error: %s", err)
+	}
+
+	want := []string{dir, "/snapshots/1/fs", "/snapshots/0/fs"}
+	if err := writeComposefsAncestors(dir, want); err != nil {
+		t.Fatalf("writeComposefsAncestors() error: %s", err)
+	}
+
+	got, err := loadComposefsAncestors(dir)
+	if err != nil {
+		t.Fatalf("loadComposefsAncestors() error: %s", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("loadComposefsAncestors() = %+v, want %+v", got, want)
+	}
+}
+
+func TestLoadComposefsAncestorsMissing(t *testing.T) {
+	if _, err := loadComposefsAncestors(t.TempDir()); err == nil {
+		t.Fatal("loadComposefsAncestors() on a dir with no ancestors file: want error, got nil")
+	}
+}
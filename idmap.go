@@ -0,0 +1,180 @@
+package zdfs
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// labelUIDMapping/labelGIDMapping carry a comma-separated list of
+	// "containerID:hostID:length" triples -- the same shape containerd
+	// already uses for OCI user namespace mappings -- describing how a
+	// snapshot's lowerdir should be remapped for the consuming pod.
+	labelUIDMapping = "containerd.io/snapshot/uidmapping"
+	labelGIDMapping = "containerd.io/snapshot/gidmapping"
+)
+
+// idMapping is one "containerID hostID length" triple of a
+// /proc/[pid]/{u,g}id_map entry.
+type idMapping struct {
+	containerID int
+	hostID      int
+	length      int
+}
+
+// idMappingFromLabels reports the UID/GID mapping requested for a
+// snapshot, if any.
+func idMappingFromLabels(info snapshots.Info) (uidMapping, gidMapping string, ok bool) {
+	uidMapping, gidMapping = info.Labels[labelUIDMapping], info.Labels[labelGIDMapping]
+	return uidMapping, gidMapping, uidMapping != "" && gidMapping != ""
+}
+
+// parseIDMapping parses a comma-separated list of
+// "containerID:hostID:length" triples.
+func parseIDMapping(s string) ([]idMapping, error) {
+	var mappings []idMapping
+	for _, part := range strings.Split(s, ",") {
+		if part == "" {
+			continue
+		}
+		fields := strings.Split(part, ":")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("invalid id mapping %q", part)
+		}
+		ids := make([]int, 3)
+		for i, f := range fields {
+			v, err := strconv.Atoi(f)
+			if err != nil {
+				return nil, fmt.Errorf("invalid id mapping %q: %s", part, err)
+			}
+			ids[i] = v
+		}
+		mappings = append(mappings, idMapping{containerID: ids[0], hostID: ids[1], length: ids[2]})
+	}
+	if len(mappings) == 0 {
+		return nil, fmt.Errorf("empty id mapping")
+	}
+	return mappings, nil
+}
+
+func toSysProcIDMap(mappings []idMapping) []syscall.SysProcIDMap {
+	out := make([]syscall.SysProcIDMap, 0, len(mappings))
+	for _, m := range mappings {
+		out = append(out, syscall.SysProcIDMap{ContainerID: m.containerID, HostID: m.hostID, Size: m.length})
+	}
+	return out
+}
+
+// openUsernsFD creates a throwaway process in a fresh user namespace
+// carrying the given UID/GID mapping, opens an fd for that namespace
+// (which keeps it alive once the process exits), and tears the process
+// back down. The returned fd is suitable for mount_setattr(MOUNT_ATTR_IDMAP).
+func openUsernsFD(uidMapping, gidMapping string) (int, error) {
+	uidMaps, err := parseIDMapping(uidMapping)
+	if err != nil {
+		return -1, errors.Wrapf(err, "invalid %s", labelUIDMapping)
+	}
+	gidMaps, err := parseIDMapping(gidMapping)
+	if err != nil {
+		return -1, errors.Wrapf(err, "invalid %s", labelGIDMapping)
+	}
+
+	cmd := exec.Command("sleep", "infinity")
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:  syscall.CLONE_NEWUSER,
+		UidMappings: toSysProcIDMap(uidMaps),
+		GidMappings: toSysProcIDMap(gidMaps),
+	}
+	if err := cmd.Start(); err != nil {
+		return -1, errors.Wrap(err, "failed to start idmap helper process")
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+
+	nsPath := fmt.Sprintf("/proc/%d/ns/user", cmd.Process.Pid)
+	f, err := os.Open(nsPath)
+	if err != nil {
+		return -1, errors.Wrapf(err, "failed to open %s", nsPath)
+	}
+	defer f.Close()
+
+	return unix.Dup(int(f.Fd()))
+}
+
+// mountIdmapped clones the already-mounted tree at srcDir with open_tree,
+// applies the UID/GID mapping via mount_setattr(MOUNT_ATTR_IDMAP), and
+// attaches the result at targetDir with move_mount -- the standard
+// idmapped-mount sequence overlay/fuse-overlayfs recently adopted. Unlike a
+// bare mount option string, this actually produces a live, remapped mount at
+// targetDir that any later "bind" mount of targetDir picks up unchanged,
+// letting the same zdfs-accelerated image be mounted as different host UIDs
+// in different pods without copying or chown-ing layers.
+func mountIdmapped(srcDir, targetDir, uidMapping, gidMapping string) error {
+	usernsFD, err := openUsernsFD(uidMapping, gidMapping)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(usernsFD)
+
+	treeFD, err := unix.OpenTree(unix.AT_FDCWD, srcDir, unix.OPEN_TREE_CLONE|unix.OPEN_TREE_CLOEXEC|unix.AT_RECURSIVE)
+	if err != nil {
+		return errors.Wrapf(err, "open_tree(%s) failed", srcDir)
+	}
+	defer unix.Close(treeFD)
+
+	attr := unix.MountAttr{
+		Attr_set:  unix.MOUNT_ATTR_IDMAP,
+		Userns_fd: uint64(usernsFD),
+	}
+	if err := unix.MountSetattr(treeFD, "", unix.AT_EMPTY_PATH, &attr); err != nil {
+		return errors.Wrapf(err, "mount_setattr(%s) failed", srcDir)
+	}
+
+	if err := os.MkdirAll(targetDir, 0755); err != nil {
+		return err
+	}
+	if err := unix.MoveMount(treeFD, "", unix.AT_FDCWD, targetDir, unix.MOVE_MOUNT_F_EMPTY_PATH); err != nil {
+		return errors.Wrapf(err, "move_mount(%s -> %s) failed", srcDir, targetDir)
+	}
+	return nil
+}
+
+// applyIDMap mounts m at a scratch directory under dir, then, if info's
+// labels request a UID/GID mapping, remaps that mount with mountIdmapped
+// and returns a plain bind mount of the remapped copy for the caller to
+// attach wherever it actually needs it. It returns ok=false, having mounted
+// nothing, when the snapshot carries no mapping -- callers should fall back
+// to returning m itself unmodified in that case.
+func applyIDMap(dir string, m *mount.Mount, info snapshots.Info) (idm mount.Mount, ok bool, err error) {
+	uidMapping, gidMapping, has := idMappingFromLabels(info)
+	if !has {
+		return mount.Mount{}, false, nil
+	}
+
+	scratchDir := path.Join(dir, "idmap-src")
+	if err := os.MkdirAll(scratchDir, 0755); err != nil {
+		return mount.Mount{}, false, err
+	}
+	if err := m.Mount(scratchDir); err != nil {
+		return mount.Mount{}, false, errors.Wrapf(err, "failed to mount %s at %s for idmapping", m.Source, scratchDir)
+	}
+
+	targetDir := path.Join(dir, "idmapped")
+	if err := mountIdmapped(scratchDir, targetDir, uidMapping, gidMapping); err != nil {
+		return mount.Mount{}, false, errors.Wrapf(err, "failed to build idmapped mount for %s", scratchDir)
+	}
+
+	return mount.Mount{Type: "bind", Source: targetDir, Options: []string{"bind"}}, true, nil
+}
@@ -0,0 +1,62 @@
+package zdfs
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseIDMapping(t *testing.T) {
+	cases := []struct {
+		name    string
+		in      string
+		want    []idMapping
+		wantErr bool
+	}{
+		{
+			name: "single",
+			in:   "0:1000:1",
+			want: []idMapping{{containerID: 0, hostID: 1000, length: 1}},
+		},
+		{
+			name: "multiple",
+			in:   "0:1000:1,1:100000:65536",
+			want: []idMapping{
+				{containerID: 0, hostID: 1000, length: 1},
+				{containerID: 1, hostID: 100000, length: 65536},
+			},
+		},
+		{
+			name:    "empty",
+			in:      "",
+			wantErr: true,
+		},
+		{
+			name:    "wrong field count",
+			in:      "0:1000",
+			wantErr: true,
+		},
+		{
+			name:    "non-numeric field",
+			in:      "0:abc:1",
+			wantErr: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := parseIDMapping(c.in)
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("parseIDMapping(%q) = %v, want error", c.in, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseIDMapping(%q) unexpected error: %s", c.in, err)
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("parseIDMapping(%q) = %+v, want %+v", c.in, got, c.want)
+			}
+		})
+	}
+}
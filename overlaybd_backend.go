@@ -0,0 +1,175 @@
+package zdfs
+
+import (
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// overlaybdLayerBackend is the original LayerBackend implementation: it
+// assembles dadi/overlaybd meta files (pre-built, locally synthesized
+// turboOCI, or TOC-driven zstd:chunked or stargz) under block/ and writes the
+// overlaybd target config that the TCMU-backed overlaybd process reads.
+type overlaybdLayerBackend struct{}
+
+func (overlaybdLayerBackend) makeConfig(dir, parent string) error {
+	logrus.Infof("ENTER makeConfig(dir: %s, parent: %s)", dir, parent)
+	dstDir := path.Join(dir, "block")
+
+	repo, digest, err := GetBlobRepoDigest(dstDir)
+	if err != nil {
+		return err
+	}
+
+	refPath := path.Join(dir, path.Join(dir, "image_ref"))
+	if b, _ := pathExists(refPath); b {
+		img, _ := os.ReadFile(refPath)
+		imageRef := string(img)
+		logrus.Infof("read imageRef from label.CRIImageRef: %s", imageRef)
+		repo, _ = constructImageBlobURL(imageRef)
+	}
+	logrus.Infof("construct repoBlobUrl: %s", repo)
+
+	size, _ := GetBlobSize(dstDir)
+	return constructSpec(dir, parent, repo, digest, size, "")
+}
+
+func (b overlaybdLayerBackend) Prepare(dir, parent string, info snapshots.Info) error {
+	dstDir := path.Join(dir, zdfsMetaDir)
+	//1.check if the dir exists. Create the dir only when dir doesn't exist.
+	exists, err := pathExists(dstDir)
+	if err != nil {
+		logrus.Errorf("LSMD ERROR PathExists(%s) err:%s", dstDir, err)
+		return err
+	}
+
+	if exists {
+		configPath := overlaybdConfPath(dir)
+		configExists, err := pathExists(configPath)
+		if err != nil {
+			logrus.Errorf("LSMD ERROR PathExists(%s) err:%s", configPath, err)
+			return err
+		}
+		if configExists {
+			logrus.Infof("%s has been created yet.", configPath)
+			return updateSpec(dir, "")
+		}
+		// config.v1.json does not exist, for early pulled layers
+		return b.makeConfig(dir, parent)
+	}
+
+	exists, _ = pathExists(path.Join(dir, "block", "config.v1.json"))
+	if exists {
+		// is new dadi format
+		return nil
+	}
+
+	//2.create tmpDir in dir
+	tmpDir, err := os.MkdirTemp(dir, "temp_for_prepare_dadimeta")
+	if err != nil {
+		logrus.Errorf("LSMD ERROR os.MkdirTemp(%s.) err:%s", tmpDir, err)
+		return err
+	}
+
+	srcDir := path.Join(dir, "fs")
+	blockDir := path.Join(dir, "block")
+	if hasMeta, _ := hasOverlaybdBlobRef(srcDir); hasMeta {
+		//3.copy the pre-built dadi meta files to tmpDir and block
+		if err := copyPulledZdfsMetaFiles(srcDir, tmpDir); err != nil {
+			logrus.Errorf("failed to copyPulledZdfsMetaFiles(%s, %s), err:%s", srcDir, tmpDir, err)
+			return err
+		}
+		if err := copyPulledZdfsMetaFiles(srcDir, blockDir); err != nil {
+			logrus.Errorf("failed to copyPulledZdfsMetaFiles(%s, %s), err:%s", srcDir, blockDir, err)
+			return err
+		}
+	} else if isZstdChunkedLayer(info) {
+		// zstd:chunked layer: range-fetch just its TOC instead of the
+		// whole blob, and let the overlaybd backend range-read individual
+		// files from the registry on demand.
+		if err := prepareZstdChunkedLayer(dir, tmpDir, blockDir, info); err != nil {
+			logrus.Errorf("failed to prepareZstdChunkedLayer(%s), err:%s", dir, err)
+			return err
+		}
+	} else if isStargzLayer(info) {
+		// estargz/stargz layer: range-fetch just its TOC, the same way
+		// zstd:chunked does, so stargz-pushed and dadi-pushed images can
+		// sit behind the same snapshotter.
+		if err := prepareStargzLayer(dir, tmpDir, blockDir, info); err != nil {
+			logrus.Errorf("failed to prepareStargzLayer(%s), err:%s", dir, err)
+			return err
+		}
+	} else if blobPath, ok := hasLocalOCILayer(info); ok {
+		// no pre-built meta: this layer was never accelerated at push
+		// time. Synthesize a turboOCI blob locally from the plain OCI
+		// layer instead of paying for a full unpack on every pull.
+		if err := convertOCILayerToTurboOCI(dir, blobPath, blockDir); err != nil {
+			logrus.Errorf("failed to convertOCILayerToTurboOCI(%s, %s), err:%s", blobPath, blockDir, err)
+			return err
+		}
+		if err := copyZdfsFiles(blockDir, tmpDir, zdfsSidecarFileNames); err != nil {
+			logrus.Errorf("failed to copyZdfsFiles(%s, %s), err:%s", blockDir, tmpDir, err)
+			return err
+		}
+	} else {
+		return fmt.Errorf("LSMD ERROR dir(%s) has no zdfs meta files", dir)
+	}
+
+	//4.rename tmpDir to zdfsmeta
+	if err = os.Rename(tmpDir, dstDir); err != nil {
+		return err
+	}
+
+	//5.generate config.v1.json
+	return b.makeConfig(dir, parent)
+}
+
+// Mount mounts the overlaybd device the TCMU backend attaches once
+// config.v1.json is in place, and hands back a bind mount of that
+// mountpoint -- the same shape the real overlaybd-snapshotter returns --
+// rather than a raw device mount nothing downstream could actually consume.
+// "overlaybd" was never a kernel filesystem type mount(2) understands;
+// overlaybdTargetDevice is a real block device formatted ext4 (the same
+// filesystem convertOCILayerToTurboOCI builds directly for synthesized
+// layers), so that's what's actually mounted here.
+func (overlaybdLayerBackend) Mount(dir string, info snapshots.Info) ([]mount.Mount, error) {
+	if exists, err := pathExists(overlaybdConfPath(dir)); err != nil {
+		return nil, err
+	} else if !exists {
+		return nil, fmt.Errorf("LSMD ERROR overlaybd config does not exist for %s", dir)
+	}
+
+	mountpoint := overlaybdMountpoint(dir)
+	if err := os.MkdirAll(mountpoint, 0755); err != nil {
+		return nil, err
+	}
+	dev := mount.Mount{
+		Type:    "ext4",
+		Source:  overlaybdTargetDevice(dir),
+		Options: []string{"ro"},
+	}
+	if err := dev.Mount(mountpoint); err != nil {
+		return nil, errors.Wrapf(err, "failed to mount overlaybd device %s at %s", dev.Source, mountpoint)
+	}
+
+	bind := mount.Mount{Type: "bind", Source: mountpoint, Options: []string{"ro", "rbind"}}
+	if idm, ok, err := applyIDMap(dir, &bind, info); err != nil {
+		return nil, err
+	} else if ok {
+		return []mount.Mount{idm}, nil
+	}
+	return []mount.Mount{bind}, nil
+}
+
+func overlaybdTargetDevice(dir string) string {
+	return path.Join(dir, "block", "overlaybd.device")
+}
+
+func overlaybdMountpoint(dir string) string {
+	return path.Join(dir, "block", "mountpoint")
+}
@@ -0,0 +1,280 @@
+package zdfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+
+	"github.com/containerd/containerd/snapshots"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// labelStargzTOCDigest mirrors the stargz-snapshotter label of the same
+	// name, copied onto the snapshot by the differ, which marks a layer as
+	// an estargz/stargz image rather than a dadi or zstd:chunked one.
+	labelStargzTOCDigest = "containerd.io/snapshot/stargz/toc.digest"
+	// labelStargzDigest/labelStargzSize carry the layer blob's registry
+	// digest and compressed size, needed to build its blob URL and to
+	// locate the footer at the end of the blob.
+	labelStargzDigest = "containerd.io/snapshot/zdfs.stargz.digest"
+	labelStargzSize   = "containerd.io/snapshot/zdfs.stargz.size"
+
+	zdfsOssTypeStargz = "stargz" // .type value for TOC-driven estargz layers
+
+	stargzTOCFile = ".stargz_toc.json" // cached, parsed TOC under zdfsmeta/
+
+	stargzTOCTarName  = "stargz.index.json" // tar entry name of the TOC inside its own gzip member
+	stargzFooterSize  = 51
+	stargzFooterMagic = "STARGZ"
+)
+
+// stargzTOCEntry is the subset of an estargz TOCEntry zdfs needs to
+// translate an overlaybd read request into a chunk fetch.
+type stargzTOCEntry struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Size        int64  `json:"size"`
+	Offset      int64  `json:"offset"`
+	ChunkOffset int64  `json:"chunkOffset"`
+	ChunkSize   int64  `json:"chunkSize"`
+	Digest      string `json:"digest"`
+}
+
+type stargzTOC struct {
+	Version int              `json:"version"`
+	Entries []stargzTOCEntry `json:"entries"`
+}
+
+// isStargzLayer reports whether info describes an estargz/stargz layer,
+// i.e. one the differ already identified by a TOC digest annotation.
+func isStargzLayer(info snapshots.Info) bool {
+	return info.Labels[labelStargzTOCDigest] != ""
+}
+
+func stargzTOCPath(dir string) string {
+	return path.Join(dir, zdfsMetaDir, stargzTOCFile)
+}
+
+// prepareStargzLayer range-fetches an estargz blob's trailing footer to
+// locate its TOC, range-fetches and ungzips the TOC itself, caches it under
+// zdfsmeta/.stargz_toc.json, and writes the usual sidecar files so the rest
+// of the zdfs machinery (GetBlobRepoDigest, GetBlobSize) keeps working
+// uniformly across dadi, zstd:chunked and stargz layers. The overlaybd
+// backend is later pointed at the cached TOC by constructSpec and issues
+// its own chunk fetches for individual files on demand.
+func prepareStargzLayer(dir, tmpDir, blockDir string, info snapshots.Info) error {
+	ref, ok := readImageRef(dir)
+	if !ok {
+		return fmt.Errorf("LSMD ERROR stargz layer %s has no image_ref", dir)
+	}
+	digest := info.Labels[labelStargzDigest]
+	if digest == "" {
+		return fmt.Errorf("LSMD ERROR stargz layer %s is missing label %s", dir, labelStargzDigest)
+	}
+	size, err := strconv.ParseInt(info.Labels[labelStargzSize], 10, 64)
+	if err != nil {
+		return errors.Wrapf(err, "stargz layer %s has an invalid label %s", dir, labelStargzSize)
+	}
+
+	blobURLBase, err := constructImageBlobURL(ref)
+	if err != nil {
+		return err
+	}
+	blobURL := path.Join(blobURLBase, digest)
+
+	toc, err := fetchStargzTOC(blobURL, size)
+	if err != nil {
+		return errors.Wrapf(err, "failed to fetch stargz TOC for %s", blobURL)
+	}
+
+	data, err := json.Marshal(toc)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path.Join(tmpDir, stargzTOCFile), data, 0666); err != nil {
+		return err
+	}
+
+	if err := writeZdfsSidecarFiles(blockDir, blobURL, uint64(size), zdfsOssTypeStargz); err != nil {
+		return err
+	}
+	logrus.Infof("prepared stargz layer %s (%d entries) from %s", dir, len(toc.Entries), blobURL)
+	return nil
+}
+
+// fetchStargzTOC range-fetches the trailing 51-byte estargz footer to
+// locate the TOC's own gzip member, then range-fetches and untars that
+// member to recover stargz.index.json.
+func fetchStargzTOC(blobURL string, size int64) (*stargzTOC, error) {
+	footer, err := fetchBlobRange(blobURL, size-stargzFooterSize, size-1)
+	if err != nil {
+		return nil, err
+	}
+	if len(footer) != stargzFooterSize {
+		return nil, fmt.Errorf("short stargz footer: got %d bytes, want %d", len(footer), stargzFooterSize)
+	}
+
+	tocOffset, err := parseStargzFooter(footer)
+	if err != nil {
+		return nil, err
+	}
+
+	compressed, err := fetchBlobRange(blobURL, tocOffset, size-stargzFooterSize-1)
+	if err != nil {
+		return nil, err
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open stargz TOC gzip member")
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("stargz TOC member has no %s entry", stargzTOCTarName)
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read stargz TOC tar member")
+		}
+		if hdr.Name != stargzTOCTarName {
+			continue
+		}
+		raw, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		var toc stargzTOC
+		if err := json.Unmarshal(raw, &toc); err != nil {
+			return nil, errors.Wrap(err, "failed to unmarshal stargz TOC")
+		}
+		return &toc, nil
+	}
+}
+
+func loadStargzTOC(dir string) (*stargzTOC, error) {
+	data, err := os.ReadFile(stargzTOCPath(dir))
+	if err != nil {
+		return nil, err
+	}
+	var toc stargzTOC
+	if err := json.Unmarshal(data, &toc); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal cached stargz TOC")
+	}
+	return &toc, nil
+}
+
+// ReadStargzFile returns the decompressed content of a single file inside a
+// prepared estargz/stargz layer at dir, range-fetching (and, via
+// fetchStargzChunk's chunkCache, deduplicating) only the chunks that back it
+// instead of the whole blob -- the shim overlaybd reads would go through to
+// translate a read request into estargz chunk fetches using the TOC's
+// offset/size table, the same role fetchChunk plays for zstd:chunked.
+// blobURL and size are the same values fetchStargzTOC used to build the
+// cached TOC.
+func ReadStargzFile(dir, blobURL string, size int64, name string) ([]byte, error) {
+	toc, err := loadStargzTOC(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to load stargz TOC for %s", dir)
+	}
+
+	var entries []stargzTOCEntry
+	for _, entry := range toc.Entries {
+		if entry.Name == name && entry.Type == "reg" {
+			entries = append(entries, entry)
+		}
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("stargz layer %s has no entry %s", dir, name)
+	}
+	// A file's chunks are independent TOC entries in file-offset order, not
+	// necessarily in the blob-offset order they were appended to the
+	// compressed stream in.
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ChunkOffset < entries[j].ChunkOffset })
+
+	var out []byte
+	for _, entry := range entries {
+		raw, err := fetchStargzChunk(blobURL, toc, entry, size)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, raw...)
+	}
+	return out, nil
+}
+
+// fetchStargzChunk range-fetches and ungzips a single chunk of an estargz
+// blob. Each chunk is its own gzip member starting at entry.Offset; estargz
+// doesn't record a compressed size per entry, so the fetched range instead
+// runs up to the next entry's Offset in the whole TOC (blob-offset order),
+// or to the end of the blob for the last one -- gzip.Reader only decodes
+// the first member of whatever it's handed, so overfetching past the
+// member's real end is harmless.
+func fetchStargzChunk(blobURL string, toc *stargzTOC, entry stargzTOCEntry, blobSize int64) ([]byte, error) {
+	cacheKey := entry.Digest
+	chunkCacheMu.Lock()
+	if data, ok := chunkCache[cacheKey]; ok {
+		chunkCacheMu.Unlock()
+		return data, nil
+	}
+	chunkCacheMu.Unlock()
+
+	end := blobSize - 1
+	for _, other := range toc.Entries {
+		if other.Offset > entry.Offset && other.Offset-1 < end {
+			end = other.Offset - 1
+		}
+	}
+
+	compressed, err := fetchBlobRange(blobURL, entry.Offset, end)
+	if err != nil {
+		return nil, err
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open gzip member of chunk at offset %d", entry.Offset)
+	}
+	defer gz.Close()
+	gz.Multistream(false)
+	raw, err := io.ReadAll(gz)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decompress chunk at offset %d", entry.Offset)
+	}
+
+	chunkCacheMu.Lock()
+	cacheChunk(cacheKey, raw)
+	chunkCacheMu.Unlock()
+	return raw, nil
+}
+
+// parseStargzFooter decodes the 16-hex-digit TOC offset estargz encodes in
+// the gzip FEXTRA field of its trailing footer member, validated by the
+// "STARGZ" magic that follows it.
+func parseStargzFooter(footer []byte) (int64, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(footer))
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to parse stargz footer")
+	}
+	defer gz.Close()
+
+	extra := gz.Header.Extra
+	if len(extra) != 16+len(stargzFooterMagic) {
+		return 0, fmt.Errorf("unrecognized stargz footer extra field length %d", len(extra))
+	}
+	if string(extra[16:]) != stargzFooterMagic {
+		return 0, fmt.Errorf("unrecognized stargz footer magic %q", extra[16:])
+	}
+	return strconv.ParseInt(string(extra[:16]), 16, 64)
+}
@@ -0,0 +1,105 @@
+package zdfs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func gzipMember(t *testing.T, data string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write([]byte(data)); err != nil {
+		t.Fatalf("gw.Write() error: %s", err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatalf("gw.Close() error: %s", err)
+	}
+	return buf.Bytes()
+}
+
+func serveRange(t *testing.T, blob []byte) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rangeHeader := r.Header.Get("Range")
+		rangeHeader = strings.TrimPrefix(rangeHeader, "bytes=")
+		parts := strings.SplitN(rangeHeader, "-", 2)
+		start, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			t.Fatalf("invalid range start %q", parts[0])
+		}
+		end, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			t.Fatalf("invalid range end %q", parts[1])
+		}
+		if end >= int64(len(blob)) {
+			end = int64(len(blob)) - 1
+		}
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(blob[start : end+1])
+	}))
+}
+
+func TestReadStargzFileMultiChunk(t *testing.T) {
+	chunk1 := gzipMember(t, "hello ")
+	chunk2 := gzipMember(t, "world")
+	blob := append(append([]byte{}, chunk1...), chunk2...)
+
+	srv := serveRange(t, blob)
+	defer srv.Close()
+
+	toc := stargzTOC{Entries: []stargzTOCEntry{
+		{Name: "file.txt", Type: "reg", Offset: 0, ChunkOffset: 0, Digest: "sha256:chunk1"},
+		{Name: "file.txt", Type: "reg", Offset: int64(len(chunk1)), ChunkOffset: 6, Digest: "sha256:chunk2"},
+	}}
+	data, err := json.Marshal(toc)
+	if err != nil {
+		t.Fatalf("json.Marshal() error: %s", err)
+	}
+
+	dir := t.TempDir()
+	if err := os.MkdirAll(path.Join(dir, zdfsMetaDir), 0755); err != nil {
+		t.Fatalf("os.MkdirAll() error: %s", err)
+	}
+	if err := os.WriteFile(stargzTOCPath(dir), data, 0644); err != nil {
+		t.Fatalf("os.WriteFile() error: %s", err)
+	}
+
+	got, err := ReadStargzFile(dir, srv.URL, int64(len(blob)), "file.txt")
+	if err != nil {
+		t.Fatalf("ReadStargzFile() unexpected error: %s", err)
+	}
+	if string(got) != "hello world" {
+		t.Errorf("ReadStargzFile() = %q, want %q", got, "hello world")
+	}
+}
+
+func TestReadStargzFileMissing(t *testing.T) {
+	toc := stargzTOC{Entries: []stargzTOCEntry{
+		{Name: "other.txt", Type: "reg"},
+	}}
+	data, err := json.Marshal(toc)
+	if err != nil {
+		t.Fatalf("json.Marshal() error: %s", err)
+	}
+
+	dir := t.TempDir()
+	if err := os.MkdirAll(path.Join(dir, zdfsMetaDir), 0755); err != nil {
+		t.Fatalf("os.MkdirAll() error: %s", err)
+	}
+	if err := os.WriteFile(stargzTOCPath(dir), data, 0644); err != nil {
+		t.Fatalf("os.WriteFile() error: %s", err)
+	}
+
+	if _, err := ReadStargzFile(dir, "http://example.invalid", 0, "file.txt"); err == nil {
+		t.Fatal("ReadStargzFile() for a missing entry: want error, got nil")
+	}
+}
@@ -0,0 +1,54 @@
+package zdfs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"testing"
+)
+
+func buildStargzFooter(t *testing.T, tocOffset int64) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz, err := gzip.NewWriterLevel(&buf, gzip.NoCompression)
+	if err != nil {
+		t.Fatalf("gzip.NewWriterLevel() error: %s", err)
+	}
+	gz.Header.Extra = []byte(fmt.Sprintf("%016x%s", tocOffset, stargzFooterMagic))
+	if err := gz.Close(); err != nil {
+		t.Fatalf("gz.Close() error: %s", err)
+	}
+	return buf.Bytes()
+}
+
+func TestParseStargzFooter(t *testing.T) {
+	footer := buildStargzFooter(t, 0xabcdef)
+	got, err := parseStargzFooter(footer)
+	if err != nil {
+		t.Fatalf("parseStargzFooter() unexpected error: %s", err)
+	}
+	if got != 0xabcdef {
+		t.Errorf("parseStargzFooter() = %#x, want %#x", got, 0xabcdef)
+	}
+}
+
+func TestParseStargzFooterBadMagic(t *testing.T) {
+	var buf bytes.Buffer
+	gz, err := gzip.NewWriterLevel(&buf, gzip.NoCompression)
+	if err != nil {
+		t.Fatalf("gzip.NewWriterLevel() error: %s", err)
+	}
+	gz.Header.Extra = []byte(fmt.Sprintf("%016xWRONGMAGIC", int64(42)))
+	if err := gz.Close(); err != nil {
+		t.Fatalf("gz.Close() error: %s", err)
+	}
+	if _, err := parseStargzFooter(buf.Bytes()); err == nil {
+		t.Fatal("parseStargzFooter() with wrong magic = nil error, want error")
+	}
+}
+
+func TestParseStargzFooterNotGzip(t *testing.T) {
+	if _, err := parseStargzFooter([]byte("not a gzip stream")); err == nil {
+		t.Fatal("parseStargzFooter() on non-gzip data = nil error, want error")
+	}
+}
@@ -0,0 +1,257 @@
+package zdfs
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/snapshots"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// labelLocalLayerBlob carries the on-disk path of a layer's raw OCI tgz
+	// blob, left behind by the differ when the image was not pre-converted
+	// to dadi/overlaybd format at push time.
+	labelLocalLayerBlob = "containerd.io/snapshot/zdfs.localLayerBlob"
+
+	turboOCIFsMetaFile = "ext4.fs.meta" // real ext4 image synthesized from the layer's tar entries
+
+	// turboOCIImageSlack is extra room, beyond the extracted tree's own
+	// size, given to mkfs.ext4 for inode tables, the journal and other
+	// filesystem overhead.
+	turboOCIImageSlack = 32 * 1024 * 1024
+)
+
+// hasLocalOCILayer reports whether this layer is a plain OCI tgz whose raw
+// blob is still on local disk, as recorded by the differ in
+// labelLocalLayerBlob. It is the counterpart of hasOverlaybdBlobRef for
+// layers that were never pre-converted at push time.
+func hasLocalOCILayer(info snapshots.Info) (string, bool) {
+	blobPath, ok := info.Labels[labelLocalLayerBlob]
+	if !ok || blobPath == "" {
+		return "", false
+	}
+	if b, err := pathExists(blobPath); err != nil || !b {
+		return "", false
+	}
+	return blobPath, true
+}
+
+// convertOCILayerToTurboOCI synthesizes an overlaybd/turboOCI blob from a
+// plain OCI tgz layer at blobPath, so that zdfs can accelerate images that
+// were never pre-converted at push time. It stream-decompresses blobPath
+// into a scratch directory, then builds a real ext4 filesystem image over
+// that tree with mkfs.ext4 -d at dstDir/turboOCIFsMetaFile -- the same
+// externally-delegated-format approach composefsLayerBackend takes with
+// mkcomposefs, since this package has no business hand-rolling a kernel
+// filesystem's on-disk layout.
+//
+// Unlike prepareZstdChunkedLayer/prepareStargzLayer, mkfs.ext4 -d bakes the
+// extracted tree's content directly into the image -- there is no on-disk
+// tool available here to emit metadata-only extents the way a real
+// overlaybd-tcmu backend would range-read from RepoBlobURL on demand, so
+// this path does a full local unpack-and-build rather than the lazy fetch
+// dadi-pushed and zstd:chunked/stargz layers get. The sidecar files are
+// still populated with a real, fetchable blob URL (not a placeholder) so
+// GetBlobRepoDigest/GetBlobSize and the resulting config.v1.json stay
+// consistent with every other layer type.
+func convertOCILayerToTurboOCI(dir, blobPath, dstDir string) error {
+	ref, ok := readImageRef(dir)
+	if !ok {
+		return fmt.Errorf("LSMD ERROR local OCI layer %s has no image_ref", dir)
+	}
+	blobURLBase, err := constructImageBlobURL(ref)
+	if err != nil {
+		return err
+	}
+
+	dgst, size, err := digestFile(blobPath)
+	if err != nil {
+		return errors.Wrapf(err, "failed to digest %s", blobPath)
+	}
+	blobURL := path.Join(blobURLBase, dgst.String())
+
+	extractDir, err := os.MkdirTemp(dstDir, "turbooci-extract")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(extractDir)
+
+	numEntries, err := extractTgz(blobPath, extractDir)
+	if err != nil {
+		return errors.Wrapf(err, "failed to extract %s", blobPath)
+	}
+
+	if err := os.MkdirAll(dstDir, 0755); err != nil {
+		return err
+	}
+	imagePath := path.Join(dstDir, turboOCIFsMetaFile)
+	if err := buildExt4Image(extractDir, imagePath); err != nil {
+		return errors.Wrapf(err, "failed to build ext4 image at %s", imagePath)
+	}
+
+	if err := writeZdfsSidecarFiles(dstDir, blobURL, uint64(size), zdfsOssTypeTurboOCI); err != nil {
+		return err
+	}
+
+	logrus.Infof("converted local OCI layer %s (%d entries) into turboOCI ext4 image %s", blobPath, numEntries, imagePath)
+	return nil
+}
+
+// extractTgz stream-decompresses and unpacks a gzip-compressed tar blob into
+// dstDir, preserving regular files, directories and symlinks, and returns
+// the number of tar entries it extracted.
+func extractTgz(blobPath, dstDir string) (int, error) {
+	f, err := os.Open(blobPath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to open gzip stream of %s", blobPath)
+	}
+	defer gr.Close()
+
+	n := 0
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n, errors.Wrapf(err, "failed to walk tar entries of %s", blobPath)
+		}
+
+		// Reject entries that would land outside dstDir -- registry images
+		// are untrusted input, and a tar entry named e.g.
+		// "../../../etc/cron.d/x" would otherwise let a malicious layer
+		// write to arbitrary host paths (CWE-22, tar-slip).
+		cleanName := filepath.Clean(hdr.Name)
+		if filepath.IsAbs(cleanName) || cleanName == ".." || strings.HasPrefix(cleanName, ".."+string(filepath.Separator)) {
+			logrus.Warnf("LSMD WARN skipping tar entry with unsafe path %q while extracting %s", hdr.Name, blobPath)
+			continue
+		}
+		target := filepath.Join(dstDir, cleanName)
+		if target != dstDir && !strings.HasPrefix(target, dstDir+string(filepath.Separator)) {
+			logrus.Warnf("LSMD WARN skipping tar entry %q that escapes %s", hdr.Name, dstDir)
+			continue
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, os.FileMode(hdr.Mode)); err != nil {
+				return n, err
+			}
+		case tar.TypeSymlink:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return n, err
+			}
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return n, err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return n, err
+			}
+			out, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(hdr.Mode))
+			if err != nil {
+				return n, err
+			}
+			if _, err := io.Copy(out, tr); err != nil {
+				out.Close()
+				return n, errors.Wrapf(err, "failed to write content of %s", hdr.Name)
+			}
+			out.Close()
+		case tar.TypeLink:
+			// hdr.Linkname is itself a tar-root-relative path into the same
+			// archive (common for multi-call binaries and shared docs), so
+			// it needs the same traversal guard as hdr.Name before we
+			// hardlink the already-extracted file at that path.
+			cleanLink := filepath.Clean(hdr.Linkname)
+			if filepath.IsAbs(cleanLink) || cleanLink == ".." || strings.HasPrefix(cleanLink, ".."+string(filepath.Separator)) {
+				logrus.Warnf("LSMD WARN skipping hardlink %q with unsafe target %q while extracting %s", hdr.Name, hdr.Linkname, blobPath)
+				continue
+			}
+			linkSrc := filepath.Join(dstDir, cleanLink)
+			if linkSrc != dstDir && !strings.HasPrefix(linkSrc, dstDir+string(filepath.Separator)) {
+				logrus.Warnf("LSMD WARN skipping hardlink %q whose target %q escapes %s", hdr.Name, hdr.Linkname, dstDir)
+				continue
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return n, err
+			}
+			if err := os.Link(linkSrc, target); err != nil {
+				return n, errors.Wrapf(err, "failed to hardlink %s to %s", hdr.Name, hdr.Linkname)
+			}
+		default:
+			// device nodes, fifos etc. are rare in application layers and
+			// not needed for turboOCI to be mountable; skip them, but log
+			// so a missing file downstream has a trail back to why.
+			logrus.Warnf("LSMD WARN skipping tar entry %q of unsupported type %c while extracting %s", hdr.Name, hdr.Typeflag, blobPath)
+			continue
+		}
+		n++
+	}
+	return n, nil
+}
+
+// buildExt4Image creates a real, kernel-mountable ext4 filesystem image at
+// imagePath populated from srcDir, by shelling out to mkfs.ext4 -d -- the
+// same tool real overlaybd/dadi tooling uses to build fsmeta images, and the
+// only way to get a genuinely parseable ext4 layout without re-implementing
+// one in Go.
+func buildExt4Image(srcDir, imagePath string) error {
+	size, err := dirSize(srcDir)
+	if err != nil {
+		return err
+	}
+	imageSizeMB := (size+turboOCIImageSlack)/(1024*1024) + 1
+
+	cmd := exec.Command("mkfs.ext4", "-q", "-F", "-d", srcDir, imagePath, fmt.Sprintf("%dM", imageSizeMB))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "mkfs.ext4 -d %s %s %dM failed: %s", srcDir, imagePath, imageSizeMB, out)
+	}
+	return nil
+}
+
+func dirSize(dir string) (int64, error) {
+	var total int64
+	err := filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total, err
+}
+
+func digestFile(p string) (digest.Digest, int64, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	dgstr := digest.Canonical.Digester()
+	size, err := io.Copy(dgstr.Hash(), f)
+	if err != nil {
+		return "", 0, err
+	}
+	return dgstr.Digest(), size, nil
+}
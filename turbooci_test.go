@@ -0,0 +1,111 @@
+package zdfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path"
+	"testing"
+)
+
+func buildTgz(t *testing.T, entries []*tar.Header, contents map[string]string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, hdr := range entries {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("tw.WriteHeader(%q) error: %s", hdr.Name, err)
+		}
+		if data, ok := contents[hdr.Name]; ok {
+			if _, err := tw.Write([]byte(data)); err != nil {
+				t.Fatalf("tw.Write(%q) error: %s", hdr.Name, err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("tw.Close() error: %s", err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatalf("gw.Close() error: %s", err)
+	}
+
+	blobPath := path.Join(t.TempDir(), "layer.tar.gz")
+	if err := os.WriteFile(blobPath, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("os.WriteFile() error: %s", err)
+	}
+	return blobPath
+}
+
+func TestExtractTgzRejectsPathTraversal(t *testing.T) {
+	blobPath := buildTgz(t, []*tar.Header{
+		{Name: "../../../etc/passwd", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len("pwned"))},
+		{Name: "/etc/shadow", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len("pwned"))},
+		{Name: "ok.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len("fine"))},
+	}, map[string]string{
+		"../../../etc/passwd": "pwned",
+		"/etc/shadow":         "pwned",
+		"ok.txt":              "fine",
+	})
+
+	dstDir := t.TempDir()
+	n, err := extractTgz(blobPath, dstDir)
+	if err != nil {
+		t.Fatalf("extractTgz() unexpected error: %s", err)
+	}
+	if n != 1 {
+		t.Errorf("extractTgz() entry count = %d, want 1 (only the safe entry)", n)
+	}
+
+	if data, err := os.ReadFile(path.Join(dstDir, "ok.txt")); err != nil || string(data) != "fine" {
+		t.Errorf("extractTgz() did not extract the safe entry: data=%q err=%s", data, err)
+	}
+	entries, err := os.ReadDir(dstDir)
+	if err != nil {
+		t.Fatalf("os.ReadDir(dstDir) error: %s", err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "ok.txt" {
+		t.Errorf("extractTgz() wrote unexpected entries into dstDir: %v", entries)
+	}
+}
+
+func TestExtractTgzHardlink(t *testing.T) {
+	blobPath := buildTgz(t, []*tar.Header{
+		{Name: "bin/busybox", Typeflag: tar.TypeReg, Mode: 0755, Size: int64(len("binary"))},
+		{Name: "bin/sh", Typeflag: tar.TypeLink, Linkname: "bin/busybox"},
+	}, map[string]string{
+		"bin/busybox": "binary",
+	})
+
+	dstDir := t.TempDir()
+	n, err := extractTgz(blobPath, dstDir)
+	if err != nil {
+		t.Fatalf("extractTgz() unexpected error: %s", err)
+	}
+	if n != 2 {
+		t.Errorf("extractTgz() entry count = %d, want 2", n)
+	}
+
+	data, err := os.ReadFile(path.Join(dstDir, "bin", "sh"))
+	if err != nil {
+		t.Fatalf("os.ReadFile(bin/sh) error: %s", err)
+	}
+	if string(data) != "binary" {
+		t.Errorf("extractTgz() hardlink content = %q, want %q", data, "binary")
+	}
+}
+
+func TestExtractTgzRejectsHardlinkTraversal(t *testing.T) {
+	blobPath := buildTgz(t, []*tar.Header{
+		{Name: "evil", Typeflag: tar.TypeLink, Linkname: "../../../etc/passwd"},
+	}, nil)
+
+	dstDir := t.TempDir()
+	if _, err := extractTgz(blobPath, dstDir); err != nil {
+		t.Fatalf("extractTgz() unexpected error: %s", err)
+	}
+	if _, err := os.Stat(path.Join(dstDir, "evil")); err == nil {
+		t.Error("extractTgz() created a hardlink escaping dstDir")
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"sync"
 
 	"github.com/containerd/accelerated-container-image/pkg/types"
+	"github.com/containerd/containerd/mount"
 	"github.com/containerd/containerd/snapshots"
 	"github.com/containerd/containerd/snapshots/storage"
 	"github.com/containerd/continuity"
@@ -36,9 +37,15 @@ const (
 	zdfsOssTypeFile     = ".type"                  //file containing the type, such as layern, commit(layer file on local dir), oss(layer file is in oss
 	zdfsTrace           = ".trace"
 
+	zdfsOssTypeTurboOCI = "turboOCI" //type value for layers converted locally from a plain OCI tgz, see convertOCILayerToTurboOCI
+
 	overlaybdBaseLayer = "/opt/overlaybd/baselayers/.commit"
 )
 
+// zdfsSidecarFileNames are the small bookkeeping files that accompany every
+// zdfs layer, regardless of which backend produced its data blob.
+var zdfsSidecarFileNames = []string{zdfsChecksumFile, zdfsOssurlFile, zdfsOssDataSizeFile, zdfsOssTypeFile, zdfsTrace}
+
 // If error is nil, the existence is valid.
 // If error is not nil, the existence is invalid. Can't make sure if path exists.
 func pathExists(path string) (bool, error) {
@@ -76,12 +83,22 @@ func overlaybdInitDebuglogPath(dir string) string {
 	return filepath.Join(dir, zdfsMetaDir, "init-debug.log")
 }
 
-func isOverlaybdLayer(dir string) (bool, error) {
+func isOverlaybdLayer(dir string, info snapshots.Info) (bool, error) {
 	exists, _ := pathExists(overlaybdConfPath(dir))
 	if exists {
 		return true, nil
 	}
 
+	if _, ok := hasLocalOCILayer(info); ok {
+		return true, nil
+	}
+	if isZstdChunkedLayer(info) {
+		return true, nil
+	}
+	if isStargzLayer(info) {
+		return true, nil
+	}
+
 	b, err := hasOverlaybdBlobRef(path.Join(dir, "fs"))
 	if err != nil {
 		logrus.Errorf("LSMD ERROR failed to IsZdfsLayerInApplyDiff(dir%s), err:%s", dir, err)
@@ -198,21 +215,50 @@ func constructSpec(dir, parent, repo, digest string, size uint64, recordTracePat
 	}
 
 	configJSON.RecordTracePath = recordTracePath
-	configJSON.Lowers = append(configJSON.Lowers, types.OverlayBDBSConfigLower{
+	lower := types.OverlayBDBSConfigLower{
 		Digest: digest,
 		Size:   int64(size),
-		Dir:    path.Join(dir, "block"),
-	})
+	}
+	blockDir := path.Join(dir, "block")
+	switch typ, _ := getTrimStringFromFile(path.Join(blockDir, zdfsOssTypeFile)); typ {
+	case zdfsOssTypeTurboOCI:
+		// a locally synthesized turboOCI layer: the fsmeta next to the
+		// config is a complete, self-contained ext4 image (see
+		// convertOCILayerToTurboOCI) rather than metadata-only extents, so
+		// unlike the other cases below RepoBlobURL isn't actually read back
+		// for this layer's own content -- it's kept consistent with the
+		// other layer types for GetBlobRepoDigest/GetBlobSize bookkeeping.
+		lower.File = path.Join(blockDir, turboOCIFsMetaFile)
+	case zdfsOssTypeZstdChunked, zdfsOssTypeStargz:
+		// a zstd:chunked or stargz layer: point the lower at the cached
+		// TOC so the overlaybd backend can range-read (or stargz
+		// chunk-fetch) individual files from the registry on demand.
+		lower.Dir = path.Join(dir, zdfsMetaDir)
+	default:
+		lower.Dir = blockDir
+	}
+	configJSON.Lowers = append(configJSON.Lowers, lower)
 	return atomicWriteOverlaybdTargetConfig(dir, &configJSON)
 }
 
 func PrepareOverlayBDSpec(ctx context.Context, key, id, dir string, info snapshots.Info, snPath func(string) string) (bool, error) {
 
-	if b, err := isOverlaybdLayer(dir); !b {
-		return false, nil
-	} else if err != nil {
-		return false, err
+	backend := selectLayerBackend(info)
+
+	// isOverlaybdLayer's markers (pre-built dadi meta, zstd:chunked/stargz
+	// annotations, a local OCI blob) only identify layers the overlaybd
+	// backend knows how to materialize. composefsLayerBackend instead
+	// converts any unpacked layer tree under dir/fs, so a snapshot that
+	// explicitly opted into it via backendLabel should engage regardless
+	// of whether those markers are present.
+	if _, isComposefs := backend.(composefsLayerBackend); !isComposefs {
+		if b, err := isOverlaybdLayer(dir, info); !b {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
 	}
+
 	s, _ := storage.GetSnapshot(ctx, key)
 	lowers := func() []string {
 		ret := []string{}
@@ -221,120 +267,74 @@ func PrepareOverlayBDSpec(ctx context.Context, key, id, dir string, info snapsho
 		}
 		return ret
 	}()
-	makeConfig := func(dir string, parent string) error {
-		logrus.Infof("ENTER makeConfig(dir: %s, parent: %s)", dir, parent)
-		dstDir := path.Join(dir, "block")
-
-		repo, digest, err := GetBlobRepoDigest(dstDir)
-		if err != nil {
-			return err
-		}
-
-		refPath := path.Join(dir, path.Join(dir, "image_ref"))
-		if b, _ := pathExists(refPath); b {
-			img, _ := os.ReadFile(refPath)
-			imageRef := string(img)
-			logrus.Infof("read imageRef from label.CRIImageRef: %s", imageRef)
-			repo, _ = constructImageBlobURL(imageRef)
-		}
-		logrus.Infof("construct repoBlobUrl: %s", repo)
-
-		size, _ := GetBlobSize(dstDir)
-		if err := constructSpec(dir, parent, repo, digest, size, ""); err != nil {
-			return err
-		}
-		return nil
-	}
-
-	doDir := func(dir string, parent string) error {
-		dstDir := path.Join(dir, zdfsMetaDir)
-		//1.check if the dir exists. Create the dir only when dir doesn't exist.
-		b, err := pathExists(dstDir)
-		if err != nil {
-			logrus.Errorf("LSMD ERROR PathExists(%s) err:%s", dstDir, err)
-			return err
-		}
-
-		if b {
-			configPath := overlaybdConfPath(dir)
-			configExists, err := pathExists(configPath)
-			if err != nil {
-				logrus.Errorf("LSMD ERROR PathExists(%s) err:%s", configPath, err)
-				return err
-			}
-			if configExists {
-				logrus.Infof("%s has been created yet.", configPath)
-				return updateSpec(dir, "")
-			}
-			// config.v1.json does not exist, for early pulled layers
-			return makeConfig(dir, parent)
-		}
-
-		b, _ = pathExists(path.Join(dir, "block", "config.v1.json"))
-		if b {
-			// is new dadi format
-			return nil
-		}
-
-		//2.create tmpDir in dir
-		tmpDir, err := os.MkdirTemp(dir, "temp_for_prepare_dadimeta")
-		if err != nil {
-			logrus.Errorf("LSMD ERROR os.MkdirTemp(%s.) err:%s", tmpDir, err)
-			return err
-		}
-
-		//3.copy meta files to tmpDir)
-		srcDir := path.Join(dir, "fs")
-		if err := copyPulledZdfsMetaFiles(srcDir, tmpDir); err != nil {
-			logrus.Errorf("failed to copyPulledZdfsMetaFiles(%s, %s), err:%s", srcDir, tmpDir, err)
-			return err
-		}
-
-		blockDir := path.Join(dir, "block")
-		if err := copyPulledZdfsMetaFiles(srcDir, blockDir); err != nil {
-			logrus.Errorf("failed to copyPulledZdfsMetaFiles(%s, %s), err:%s", srcDir, blockDir, err)
-			return err
-		}
-
-		//4.rename tmpDir to zdfsmeta
-		if err = os.Rename(tmpDir, dstDir); err != nil {
-			return err
-		}
-
-		//5.generate config.v1.json
-		return makeConfig(dir, parent)
-	}
 
 	num := len(lowers)
 	parent := ""
 	for m := 0; m < num; m++ {
 		dir := lowers[num-m-1]
-		if err := doDir(dir, parent); err != nil {
-			logrus.Errorf("LSMD ERROR doDir(%s) err:%s", dir, err)
+		// parents were already materialized by their own Prepare call; info
+		// only describes the snapshot currently being prepared (id below).
+		if err := backend.Prepare(dir, parent, snapshots.Info{}); err != nil {
+			logrus.Errorf("LSMD ERROR backend.Prepare(%s) err:%s", dir, err)
 			return true, err
 		}
 		parent = dir
 	}
 
-	return true, doDir(snPath(id), parent)
+	return true, backend.Prepare(snPath(id), parent, info)
+}
+
+// MountZdfsLayer returns the mounts containerd should use to expose dir's
+// merged view to a container. It is the Mount counterpart to
+// PrepareOverlayBDSpec -- call it once PrepareOverlayBDSpec has returned
+// true for dir -- and dispatches to whichever LayerBackend info selects, so
+// callers do not need to know whether dir was materialized by the overlaybd
+// or composefs path.
+func MountZdfsLayer(dir string, info snapshots.Info) ([]mount.Mount, error) {
+	return selectLayerBackend(info).Mount(dir, info)
 }
 
+// copyPulledZdfsMetaFiles copies the pre-built dadi/overlaybd meta files
+// (the .lsmt blob plus its sidecars) that a zdfs-aware push already left
+// behind in srcDir. See convertOCILayerToTurboOCI for the other branch,
+// which synthesizes these files locally for layers that were never
+// pre-converted.
 func copyPulledZdfsMetaFiles(srcDir, dstDir string) error {
-	fileNames := []string{iNewFormat, zdfsChecksumFile, zdfsOssurlFile, zdfsOssDataSizeFile, zdfsOssTypeFile, zdfsTrace}
+	return copyZdfsFiles(srcDir, dstDir, append([]string{iNewFormat}, zdfsSidecarFileNames...))
+}
+
+// copyZdfsFiles materializes fileNames from srcDir into dstDir by hardlinking
+// them out of the shared, content-addressed blob store (see blobstore.go),
+// which stores at most one copy of each distinct meta file's content no
+// matter how many snapshots across how many images reference it.
+func copyZdfsFiles(srcDir, dstDir string, fileNames []string) error {
 	for _, name := range fileNames {
 		srcPath := path.Join(srcDir, name)
 		if _, err := os.Stat(srcPath); err != nil && os.IsNotExist(err) {
 			continue
 		}
-		data, err := os.ReadFile(srcPath)
-		if err != nil {
-			logrus.Errorf("LSMD ERROR ioutil.ReadFile(srcDir:%s, name:%s) dstDir:%s, err:%s", srcDir, name, dstDir, err)
-			return err
-		}
-		if err := os.WriteFile(path.Join(dstDir, name), data, 0666); err != nil {
-			logrus.Errorf("LSMD ERROR ioutil.WriteFile(path.Join(dstDir:%s, name:%s) srcDir:%s err:%s", dstDir, name, srcDir, err)
+		if err := linkIntoBlobStore(srcPath, path.Join(dstDir, name)); err != nil {
+			logrus.Errorf("LSMD ERROR linkIntoBlobStore(srcDir:%s, name:%s) dstDir:%s, err:%s", srcDir, name, dstDir, err)
 			return err
 		}
 	}
 	return nil
 }
+
+// writeZdfsSidecarFiles records a locally or remotely synthesized layer's
+// blob URL, size and format in the same sidecar files GetBlobRepoDigest and
+// GetBlobSize already read, so the rest of the zdfs machinery works
+// uniformly regardless of which backend produced the layer's data blob.
+// Like copyZdfsFiles, it commits each file through the shared blob store
+// (see blobstore.go) rather than writing it directly, so ReleaseZdfsBlobs'
+// refcounts stay accurate regardless of which backend wrote a snapshot's
+// sidecars.
+func writeZdfsSidecarFiles(dstDir, ossURL string, size uint64, typ string) error {
+	if err := writeIntoBlobStore(path.Join(dstDir, zdfsOssurlFile), []byte(ossURL)); err != nil {
+		return err
+	}
+	if err := writeIntoBlobStore(path.Join(dstDir, zdfsOssDataSizeFile), []byte(strconv.FormatUint(size, 10))); err != nil {
+		return err
+	}
+	return writeIntoBlobStore(path.Join(dstDir, zdfsOssTypeFile), []byte(typ))
+}
@@ -0,0 +1,38 @@
+package zdfs
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func buildZstdChunkedFooter(tocOffset, tocCompressedSize int64, magic uint64) []byte {
+	footer := make([]byte, zstdChunkedFooterSize)
+	binary.LittleEndian.PutUint64(footer[0:8], uint64(tocOffset))
+	binary.LittleEndian.PutUint64(footer[8:16], uint64(tocCompressedSize))
+	binary.LittleEndian.PutUint64(footer[24:32], magic)
+	return footer
+}
+
+func TestParseZstdChunkedFooter(t *testing.T) {
+	footer := buildZstdChunkedFooter(12345, 678, zstdSkippableFrameMagic)
+	gotOffset, gotSize, err := parseZstdChunkedFooter(footer)
+	if err != nil {
+		t.Fatalf("parseZstdChunkedFooter() unexpected error: %s", err)
+	}
+	if gotOffset != 12345 || gotSize != 678 {
+		t.Errorf("parseZstdChunkedFooter() = (%d, %d), want (12345, 678)", gotOffset, gotSize)
+	}
+}
+
+func TestParseZstdChunkedFooterBadMagic(t *testing.T) {
+	footer := buildZstdChunkedFooter(12345, 678, 0xdeadbeef)
+	if _, _, err := parseZstdChunkedFooter(footer); err == nil {
+		t.Fatal("parseZstdChunkedFooter() with wrong magic = nil error, want error")
+	}
+}
+
+func TestParseZstdChunkedFooterShort(t *testing.T) {
+	if _, _, err := parseZstdChunkedFooter(make([]byte, zstdChunkedFooterSize-1)); err == nil {
+		t.Fatal("parseZstdChunkedFooter() with short footer = nil error, want error")
+	}
+}